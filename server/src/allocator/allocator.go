@@ -0,0 +1,169 @@
+// Package allocator hands out WireGuard peer addresses from a server's
+// configured subnet(s). It replaces the old NextHost counter, which only
+// understood IPv4 /24s, never reused addresses freed by deleted clients,
+// and had no concept of IPv6 at all.
+package allocator
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// Allocator allocates from an IPv4 pool and, when dual-stack is enabled, a
+// parallel IPv6 pool. A client's Address is always "v4" or "v4, v6".
+type Allocator struct {
+	mu sync.Mutex
+	v4 *pool
+	v6 *pool
+}
+
+// Config describes the subnet(s) an Allocator should serve from.
+type Config struct {
+	SubnetCIDR  string // required, e.g. 10.8.0.0/24
+	ServerIP    string // required, reserved so it's never handed to a client
+	SubnetCIDR6 string // optional, e.g. fd00:8::/64
+	ServerIP6   string // required if SubnetCIDR6 is set
+}
+
+func New(cfg Config) (*Allocator, error) {
+	v4Prefix, err := netip.ParsePrefix(cfg.SubnetCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("allocator: invalid SubnetCIDR: %w", err)
+	}
+	serverIP, err := netip.ParseAddr(cfg.ServerIP)
+	if err != nil {
+		return nil, fmt.Errorf("allocator: invalid ServerIP: %w", err)
+	}
+	v4Pool, err := newPool(v4Prefix, serverIP)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Allocator{v4: v4Pool}
+	if cfg.SubnetCIDR6 == "" {
+		return a, nil
+	}
+
+	v6Prefix, err := netip.ParsePrefix(cfg.SubnetCIDR6)
+	if err != nil {
+		return nil, fmt.Errorf("allocator: invalid SubnetCIDR6: %w", err)
+	}
+	serverIP6, err := netip.ParseAddr(cfg.ServerIP6)
+	if err != nil {
+		return nil, fmt.Errorf("allocator: invalid ServerIP6: %w", err)
+	}
+	v6Pool, err := newPool(v6Prefix, serverIP6)
+	if err != nil {
+		return nil, err
+	}
+	a.v6 = v6Pool
+	return a, nil
+}
+
+// DualStack reports whether this Allocator also hands out IPv6 addresses.
+func (a *Allocator) DualStack() bool { return a.v6 != nil }
+
+// LoadExisting marks every address already assigned to a persisted client as
+// allocated, so a restart never hands the same address out twice. addresses
+// are in the same "v4" / "v4, v6" form Allocate/Format produce.
+func (a *Allocator) LoadExisting(addresses []string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, addr := range addresses {
+		if err := a.markAllocatedLocked(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Allocator) markAllocatedLocked(addresses string) error {
+	for _, part := range strings.Split(addresses, ",") {
+		addr, err := parseHost(part)
+		if err != nil {
+			return err
+		}
+		if addr.Is4() {
+			if a.v4 != nil {
+				if err := a.v4.markAllocated(addr); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if a.v6 != nil {
+			if err := a.v6.markAllocated(addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Allocate claims the lowest free IPv4 host, and the lowest free IPv6 host
+// too when dual-stack is enabled, and formats them as a client Address.
+// On failure nothing is left allocated.
+func (a *Allocator) Allocate() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	v4, err := a.v4.allocate()
+	if err != nil {
+		return "", err
+	}
+	if a.v6 == nil {
+		return formatHost(v4), nil
+	}
+
+	v6, err := a.v6.allocate()
+	if err != nil {
+		_ = a.v4.release(v4)
+		return "", err
+	}
+	return formatHost(v4) + ", " + formatHost(v6), nil
+}
+
+// Release returns a previously-allocated client Address to its pool(s) so it
+// can be reused.
+func (a *Allocator) Release(addresses string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, part := range strings.Split(addresses, ",") {
+		addr, err := parseHost(part)
+		if err != nil {
+			return err
+		}
+		if addr.Is4() {
+			if a.v4 != nil {
+				if err := a.v4.release(addr); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if a.v6 != nil {
+			if err := a.v6.release(addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseHost(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	return netip.ParseAddr(s)
+}
+
+func formatHost(addr netip.Addr) string {
+	if addr.Is4() {
+		return addr.String() + "/32"
+	}
+	return addr.String() + "/128"
+}
@@ -0,0 +1,134 @@
+package allocator
+
+import "testing"
+
+func TestNewRejectsUnsupportedPrefixLengths(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"v4 /30 is the smallest allowed", Config{SubnetCIDR: "10.8.0.0/30", ServerIP: "10.8.0.1"}, false},
+		{"v4 /31 has no usable hosts", Config{SubnetCIDR: "10.8.0.0/31", ServerIP: "10.8.0.0"}, true},
+		{"v4 /8 is the largest allowed", Config{SubnetCIDR: "10.0.0.0/8", ServerIP: "10.0.0.1"}, false},
+		{"v4 /7 is too large", Config{SubnetCIDR: "10.0.0.0/7", ServerIP: "10.0.0.1"}, true},
+		{"v6 /64 is the largest allowed", Config{SubnetCIDR: "10.8.0.0/24", ServerIP: "10.8.0.1", SubnetCIDR6: "fd00:8::/64", ServerIP6: "fd00:8::1"}, false},
+		{"v6 /63 is too large", Config{SubnetCIDR: "10.8.0.0/24", ServerIP: "10.8.0.1", SubnetCIDR6: "fd00:8::/63", ServerIP6: "fd00:8::1"}, true},
+		{"v6 /126 is the smallest allowed", Config{SubnetCIDR: "10.8.0.0/24", ServerIP: "10.8.0.1", SubnetCIDR6: "fd00:8::/126", ServerIP6: "fd00:8::1"}, false},
+		{"v6 /127 has no usable hosts", Config{SubnetCIDR: "10.8.0.0/24", ServerIP: "10.8.0.1", SubnetCIDR6: "fd00:8::/127", ServerIP6: "fd00:8::"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New(%+v) error = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllocateSkipsNetworkBroadcastAndServerIP(t *testing.T) {
+	a, err := New(Config{SubnetCIDR: "10.8.0.0/30", ServerIP: "10.8.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// /30 has two usable hosts: .1 and .2. .1 is the server IP (reserved),
+	// so the only address Allocate can ever hand out is .2.
+	got, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.8.0.2/32" {
+		t.Fatalf("Allocate() = %q, want 10.8.0.2/32", got)
+	}
+	if _, err := a.Allocate(); err == nil {
+		t.Fatal("Allocate() on an exhausted pool succeeded, want error")
+	}
+}
+
+func TestReleaseAllowsReuse(t *testing.T) {
+	a, err := New(Config{SubnetCIDR: "10.8.0.0/30", ServerIP: "10.8.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Release(got); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := a.Allocate(); err != nil || again != got {
+		t.Fatalf("Allocate() after Release = (%q, %v), want (%q, nil)", again, err, got)
+	}
+}
+
+func TestLoadExistingPreventsDoubleAllocation(t *testing.T) {
+	a, err := New(Config{SubnetCIDR: "10.8.0.0/30", ServerIP: "10.8.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadExisting([]string{"10.8.0.2/32"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Allocate(); err == nil {
+		t.Fatal("Allocate() handed out an address LoadExisting had already claimed")
+	}
+}
+
+func TestDualStackAllocateFormatsBothFamilies(t *testing.T) {
+	a, err := New(Config{
+		SubnetCIDR:  "10.8.0.0/24",
+		ServerIP:    "10.8.0.1",
+		SubnetCIDR6: "fd00:8::/126",
+		ServerIP6:   "fd00:8::1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.DualStack() {
+		t.Fatal("DualStack() = false, want true")
+	}
+	got, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "10.8.0.2/32, fd00:8::2/128" {
+		t.Fatalf("Allocate() = %q, want 10.8.0.2/32, fd00:8::2/128", got)
+	}
+	if err := a.Release(got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocateReleasesV4WhenV6Exhausted(t *testing.T) {
+	// v4 /29 has plenty of spare hosts; v6 /126 is pinned down to exactly
+	// one free host via LoadExisting, so the second Allocate() call fails
+	// on the v6 half after the v4 half already succeeded.
+	a, err := New(Config{
+		SubnetCIDR:  "10.8.0.0/29",
+		ServerIP:    "10.8.0.1",
+		SubnetCIDR6: "fd00:8::/126",
+		ServerIP6:   "fd00:8::1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.LoadExisting([]string{"fd00:8::2/128"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Allocate(); err != nil {
+		t.Fatalf("first Allocate() should consume the last free v6 host: %v", err)
+	}
+
+	before := len(a.v4.allocated)
+	for i := 0; i < 3; i++ {
+		if _, err := a.Allocate(); err == nil {
+			t.Fatal("Allocate() succeeded against an exhausted v6 pool, want error")
+		}
+	}
+	if after := len(a.v4.allocated); after != before {
+		t.Fatalf("v4 allocations leaked across failed v6 allocations: before %d, after %d", before, after)
+	}
+}
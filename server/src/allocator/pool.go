@@ -0,0 +1,133 @@
+package allocator
+
+import (
+	"fmt"
+	"math/big"
+	"net/netip"
+)
+
+// pool tracks allocation state for a single address family within one CIDR.
+// Allocated and reserved hosts are tracked by their big.Int offset from the
+// network address rather than by a fixed-size bitmap, so the same code
+// handles both a /24 (254 usable hosts) and a /64 (2^64-1 usable hosts)
+// without overflowing a machine word.
+type pool struct {
+	prefix    netip.Prefix // masked network prefix
+	is4       bool
+	base      *big.Int // network address as an integer
+	total     *big.Int // number of host addresses in the prefix (2^hostBits)
+	reserved  map[string]struct{}
+	allocated map[string]struct{}
+}
+
+func newPool(prefix netip.Prefix, reserve ...netip.Addr) (*pool, error) {
+	if !prefix.IsValid() {
+		return nil, fmt.Errorf("invalid prefix %s", prefix)
+	}
+	network := prefix.Masked()
+	is4 := network.Addr().Is4()
+
+	addrBits := 128
+	minHostBits, maxHostBits := 2, 64 // /126..../64
+	if is4 {
+		addrBits = 32
+		minHostBits, maxHostBits = 2, 24 // /30..../8
+	}
+	hostBits := addrBits - network.Bits()
+	if hostBits < minHostBits || hostBits > maxHostBits {
+		return nil, fmt.Errorf("unsupported prefix length /%d for %s", network.Bits(), network)
+	}
+
+	total := new(big.Int).Lsh(big.NewInt(1), uint(hostBits))
+	p := &pool{
+		prefix:    network,
+		is4:       is4,
+		base:      addrToInt(network.Addr()),
+		total:     total,
+		reserved:  map[string]struct{}{"0": {}}, // network address itself
+		allocated: map[string]struct{}{},
+	}
+	if is4 {
+		broadcast := new(big.Int).Sub(total, big.NewInt(1))
+		p.reserved[broadcast.String()] = struct{}{}
+	}
+	for _, addr := range reserve {
+		if !addr.IsValid() {
+			continue
+		}
+		off, err := p.offsetOf(addr)
+		if err != nil {
+			return nil, err
+		}
+		p.reserved[off.String()] = struct{}{}
+	}
+	return p, nil
+}
+
+func (p *pool) offsetOf(addr netip.Addr) (*big.Int, error) {
+	if !p.prefix.Contains(addr) {
+		return nil, fmt.Errorf("address %s is not in %s", addr, p.prefix)
+	}
+	return new(big.Int).Sub(addrToInt(addr), p.base), nil
+}
+
+func (p *pool) addrAt(offset *big.Int) netip.Addr {
+	return intToAddr(new(big.Int).Add(p.base, offset), p.is4)
+}
+
+// allocate returns the lowest host address not already taken or reserved.
+func (p *pool) allocate() (netip.Addr, error) {
+	offset := new(big.Int)
+	one := big.NewInt(1)
+	for offset.Cmp(p.total) < 0 {
+		key := offset.String()
+		_, taken := p.allocated[key]
+		_, isReserved := p.reserved[key]
+		if !taken && !isReserved {
+			p.allocated[key] = struct{}{}
+			return p.addrAt(offset), nil
+		}
+		offset = new(big.Int).Add(offset, one)
+	}
+	return netip.Addr{}, fmt.Errorf("address pool %s exhausted", p.prefix)
+}
+
+func (p *pool) markAllocated(addr netip.Addr) error {
+	off, err := p.offsetOf(addr)
+	if err != nil {
+		return err
+	}
+	p.allocated[off.String()] = struct{}{}
+	return nil
+}
+
+func (p *pool) release(addr netip.Addr) error {
+	off, err := p.offsetOf(addr)
+	if err != nil {
+		return err
+	}
+	delete(p.allocated, off.String())
+	return nil
+}
+
+func addrToInt(addr netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(addr.AsSlice())
+}
+
+func intToAddr(i *big.Int, is4 bool) netip.Addr {
+	width := 16
+	if is4 {
+		width = 4
+	}
+	buf := make([]byte, width)
+	b := i.Bytes()
+	copy(buf[width-len(b):], b)
+	if is4 {
+		var a [4]byte
+		copy(a[:], buf)
+		return netip.AddrFrom4(a)
+	}
+	var a [16]byte
+	copy(a[:], buf)
+	return netip.AddrFrom16(a)
+}
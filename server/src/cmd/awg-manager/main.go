@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
@@ -12,34 +13,17 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-)
-
-type serverState struct {
-	ServerPrivateKey string `json:"serverPrivateKey"`
-	ServerPublicKey  string `json:"serverPublicKey"`
-
-	// For address allocation
-	SubnetCIDR string `json:"subnetCidr"` // e.g. 10.8.0.0/24
-	ServerIP   string `json:"serverIp"`   // e.g. 10.8.0.1
-	NextHost   int    `json:"nextHost"`   // next host octet/index inside subnet
-}
 
-type client struct {
-	ID        string     `json:"id"`
-	Name      string     `json:"name"`
-	PublicKey string     `json:"publicKey"`
-	PrivKey   string     `json:"privateKey"`
-	Address   string     `json:"address"` // e.g. 10.8.0.2/32
-	CreatedAt time.Time  `json:"createdAt"`
-	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
-}
+	"github.com/OxCom/amneziawg/server/src/allocator"
+	"github.com/OxCom/amneziawg/server/src/store"
+)
 
 type clientPublic struct {
 	ID        string     `json:"id"`
@@ -50,7 +34,7 @@ type clientPublic struct {
 	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
 }
 
-func toPublic(c client) clientPublic {
+func toPublic(c store.Client) clientPublic {
 	return clientPublic{
 		ID:        c.ID,
 		Name:      c.Name,
@@ -61,33 +45,50 @@ func toPublic(c client) clientPublic {
 	}
 }
 
-type dlToken struct {
-	Token     string    `json:"token"`
-	ClientID  string    `json:"clientId"`
-	ExpiresAt time.Time `json:"expiresAt"`
-	Used      bool      `json:"used"`
-}
-
 type app struct {
 	dataDir string
 	iface   string
 	port    int
 	listen  string
 
-	endpoint   string // WG_ENDPOINT domain:port (optional)
-	adminToken string
+	endpoint      string // WG_ENDPOINT domain:port (optional)
+	adminToken    string
+	metricsSecret string // gates /metrics; defaults to adminToken when METRICS_SECRET is unset
 
-	mu sync.Mutex
+	metrics *metricsCollector
+
+	// wg is a long-lived netlink handle used to reconfigure the interface
+	// in place. It is nil when wgctrl.New failed to open (e.g. no
+	// permission, module not loaded), in which case applyServerConfig
+	// always falls back to shelling out to `awg setconf`.
+	wg *wgctrl.Client
+
+	// applyMu serializes the read-device/diff/write-device sequence in
+	// applyServerConfig. Without it, two concurrent create/delete requests
+	// can race: whichever ConfigureDevice call lands last wins, even if it
+	// was computed from a staler client list, leaving the live interface
+	// diverged from the DB until the next mutation happens to fix it.
+	applyMu sync.Mutex
+
+	db    *store.Store
+	alloc *allocator.Allocator
 }
 
 func main() {
 	var dataDir, iface, listen string
 	var port int
+	var listenTLS, tlsCert, tlsKey, acmeDomains, acmeEmail, acmeCache string
 
 	flag.StringVar(&dataDir, "data-dir", "/data", "data dir")
 	flag.StringVar(&iface, "iface", "wg0", "interface name")
 	flag.IntVar(&port, "port", 51820, "listen port UDP")
 	flag.StringVar(&listen, "listen", "0.0.0.0:8080", "http listen")
+	flag.StringVar(&listenTLS, "listen-tls", "", "https listen address; enables TLS alongside -tls-cert/-tls-key or -acme-domains")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file (PEM)")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file (PEM)")
+	flag.StringVar(&acmeDomains, "acme-domains", "", "comma-separated domains to obtain a Let's Encrypt certificate for via ACME; takes priority over -tls-cert/-tls-key")
+	flag.StringVar(&acmeEmail, "acme-email", "", "contact email for ACME registration")
+	flag.StringVar(&acmeCache, "acme-cache", "", "directory to cache ACME certificates in (default: <data-dir>/acme-cache)")
 	flag.Parse()
 
 	adminToken := os.Getenv("ADMIN_TOKEN")
@@ -95,13 +96,27 @@ func main() {
 		log.Fatal("ADMIN_TOKEN is required")
 	}
 
+	metricsSecret := os.Getenv("METRICS_SECRET")
+	if metricsSecret == "" {
+		metricsSecret = adminToken
+	}
+
 	a := &app{
-		dataDir:    dataDir,
-		iface:      iface,
-		port:       port,
-		listen:     listen,
-		endpoint:   os.Getenv("WG_ENDPOINT"),
-		adminToken: adminToken,
+		dataDir:       dataDir,
+		iface:         iface,
+		port:          port,
+		listen:        listen,
+		endpoint:      os.Getenv("WG_ENDPOINT"),
+		adminToken:    adminToken,
+		metricsSecret: metricsSecret,
+		metrics:       newMetricsCollector(),
+	}
+
+	wg, err := wgctrl.New()
+	if err != nil {
+		log.Printf("wgctrl unavailable, will shell out to awg setconf for reconfiguration: %v", err)
+	} else {
+		a.wg = wg
 	}
 
 	if err := os.MkdirAll(dataDir, 0o750); err != nil {
@@ -117,10 +132,42 @@ func main() {
 	if serverIP == "" {
 		log.Fatal("WG_ADDRESS is required (e.g. 10.8.0.1/24)")
 	}
+	// Dual-stack IPv6 is opt-in: both must be set, or neither.
+	subnet6 := os.Getenv("WG_SUBNET6")
+	serverIP6 := strings.Split(os.Getenv("WG_ADDRESS6"), "/")[0]
+
+	db, err := store.Open(filepath.Join(dataDir, "awg.db"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.db = db
+
+	st, err := a.ensureServerState(subnet, serverIP, subnet6, serverIP6)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if err := a.ensureServerState(subnet, serverIP); err != nil {
+	alloc, err := allocator.New(allocator.Config{
+		SubnetCIDR:  st.SubnetCIDR,
+		ServerIP:    st.ServerIP,
+		SubnetCIDR6: st.SubnetCIDR6,
+		ServerIP6:   st.ServerIP6,
+	})
+	if err != nil {
 		log.Fatal(err)
 	}
+	existing, err := a.db.ListClients(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	addresses := make([]string, 0, len(existing))
+	for _, c := range existing {
+		addresses = append(addresses, c.Address)
+	}
+	if err := alloc.LoadExisting(addresses); err != nil {
+		log.Fatal(err)
+	}
+	a.alloc = alloc
 
 	mux := http.NewServeMux()
 
@@ -142,117 +189,67 @@ func main() {
 
 	mux.HandleFunc("/api/clients", withAuth(a.handleClients))
 	mux.HandleFunc("/api/clients/", withAuth(a.handleClientByID))
+	mux.HandleFunc("/api/server/obfuscation", withAuth(a.handleServerObfuscation))
 	mux.HandleFunc("/dl/", a.handleDownloadToken) // public, token-gated
+	mux.HandleFunc("/metrics", a.handleMetrics)   // own auth: METRICS_SECRET, falling back to admin token
 
-	log.Printf("listening on %s", listen)
-	log.Fatal(http.ListenAndServe(listen, mux))
-}
-
-func (a *app) serverStatePath() string { return filepath.Join(a.dataDir, "server.json") }
-func (a *app) clientsPath() string     { return filepath.Join(a.dataDir, "clients.json") }
-func (a *app) tokensPath() string      { return filepath.Join(a.dataDir, "dl-tokens.json") }
-
-func (a *app) ensureServerState(subnetCIDR, serverIP string) error {
-	p := a.serverStatePath()
-	if _, err := os.Stat(p); err == nil {
-		return nil
+	if err := a.serve(mux, listen, listenTLS, tlsCert, tlsKey, acmeDomains, acmeEmail, acmeCache); err != nil {
+		log.Fatal(err)
 	}
+}
 
+// ensureServerState seeds the server_state row with a fresh keypair on
+// first boot; on subsequent boots it's a no-op since store.EnsureServerState
+// finds the existing row and returns it as-is.
+func (a *app) ensureServerState(subnetCIDR, serverIP, subnetCIDR6, serverIP6 string) (store.ServerState, error) {
 	_, ipnet, err := net.ParseCIDR(subnetCIDR)
 	if err != nil {
-		return fmt.Errorf("invalid WG_SUBNET: %w", err)
+		return store.ServerState{}, fmt.Errorf("invalid WG_SUBNET: %w", err)
 	}
 	if !ipnet.Contains(net.ParseIP(serverIP)) {
-		return fmt.Errorf("server ip %s is not in subnet %s", serverIP, subnetCIDR)
+		return store.ServerState{}, fmt.Errorf("server ip %s is not in subnet %s", serverIP, subnetCIDR)
+	}
+	if (subnetCIDR6 == "") != (serverIP6 == "") {
+		return store.ServerState{}, fmt.Errorf("WG_SUBNET6 and WG_ADDRESS6 must both be set, or neither")
+	}
+	if subnetCIDR6 != "" {
+		_, ipnet6, err := net.ParseCIDR(subnetCIDR6)
+		if err != nil {
+			return store.ServerState{}, fmt.Errorf("invalid WG_SUBNET6: %w", err)
+		}
+		if !ipnet6.Contains(net.ParseIP(serverIP6)) {
+			return store.ServerState{}, fmt.Errorf("server ipv6 %s is not in subnet %s", serverIP6, subnetCIDR6)
+		}
 	}
 
 	priv, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		return err
+		return store.ServerState{}, err
 	}
 	pub := priv.PublicKey()
 
-	// Start allocating from host .2 (common convention). More generally, NextHost=2.
-	st := serverState{
+	seed := store.ServerState{
 		ServerPrivateKey: priv.String(),
 		ServerPublicKey:  pub.String(),
 		SubnetCIDR:       subnetCIDR,
 		ServerIP:         serverIP,
 		NextHost:         2,
+		SubnetCIDR6:      subnetCIDR6,
+		ServerIP6:        serverIP6,
 	}
-	b, _ := json.MarshalIndent(&st, "", "  ")
-	return os.WriteFile(p, b, 0o600)
-}
-
-func (a *app) readServerState() (serverState, error) {
-	var st serverState
-	b, err := os.ReadFile(a.serverStatePath())
-	if err != nil {
-		return st, err
-	}
-	if err := json.Unmarshal(b, &st); err != nil {
-		return st, err
-	}
-	return st, nil
-}
-
-func (a *app) writeServerState(st serverState) error {
-	b, _ := json.MarshalIndent(&st, "", "  ")
-	return os.WriteFile(a.serverStatePath(), b, 0o600)
-}
-
-func (a *app) loadClients() ([]client, error) {
-	if _, err := os.Stat(a.clientsPath()); os.IsNotExist(err) {
-		return []client{}, nil
-	}
-	b, err := os.ReadFile(a.clientsPath())
-	if err != nil {
-		return nil, err
-	}
-	var cs []client
-	if err := json.Unmarshal(b, &cs); err != nil {
-		return nil, err
-	}
-	return cs, nil
-}
-
-func (a *app) saveClients(cs []client) error {
-	b, _ := json.MarshalIndent(cs, "", "  ")
-	return os.WriteFile(a.clientsPath(), b, 0o600)
-}
-
-func (a *app) loadTokens() ([]dlToken, error) {
-	if _, err := os.Stat(a.tokensPath()); os.IsNotExist(err) {
-		return []dlToken{}, nil
-	}
-	b, err := os.ReadFile(a.tokensPath())
-	if err != nil {
-		return nil, err
-	}
-	var ts []dlToken
-	if err := json.Unmarshal(b, &ts); err != nil {
-		return nil, err
-	}
-	return ts, nil
-}
-
-func (a *app) saveTokens(ts []dlToken) error {
-	b, _ := json.MarshalIndent(ts, "", "  ")
-	return os.WriteFile(a.tokensPath(), b, 0o600)
+	return a.db.EnsureServerState(context.Background(), seed)
 }
 
 func (a *app) handleClients(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		cs, err := a.loadClients()
+		cs, err := a.db.ListClients(r.Context())
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
 
 		out := make([]clientPublic, 0, len(cs))
-
 		for _, c := range cs {
 			out = append(out, toPublic(c))
 		}
@@ -292,6 +289,45 @@ func (a *app) handleClientByID(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "not found", http.StatusNotFound)
 }
 
+// handleServerObfuscation lets the admin set the server-wide junk profile
+// applied to every client; obfuscation has no per-client equivalent since
+// Jc/Jmin/Jmax/S1/S2/H1-4 are [Interface]-level handshake parameters the
+// server and every peer must agree on identically.
+func (a *app) handleServerObfuscation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var o store.ObfuscationParams
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	if err := o.Validate(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	st, err := a.db.GetServerState(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	st.Obfuscation = o
+	if err := a.db.SaveServerState(r.Context(), st); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if err := a.applyServerConfig(r.Context(), st); err != nil {
+		http.Error(w, "apply failed: "+err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st.Obfuscation)
+}
+
 func (a *app) createClient(w http.ResponseWriter, r *http.Request) {
 	type req struct {
 		Name      string  `json:"name"`
@@ -318,21 +354,13 @@ func (a *app) createClient(w http.ResponseWriter, r *http.Request) {
 		exp = &t
 	}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	st, err := a.readServerState()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	cs, err := a.loadClients()
+	st, err := a.db.GetServerState(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	addr, err := allocateNextAddress(&st)
+	addr, err := a.alloc.Allocate()
 	if err != nil {
 		http.Error(w, "address allocation failed: "+err.Error(), 500)
 		return
@@ -340,32 +368,34 @@ func (a *app) createClient(w http.ResponseWriter, r *http.Request) {
 
 	priv, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
+		_ = a.alloc.Release(addr)
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	pub := priv.PublicKey()
 
-	id := makeID()
-	c := client{
-		ID:        id,
-		Name:      name,
-		PublicKey: pub.String(),
-		PrivKey:   priv.String(),
-		Address:   addr,
-		CreatedAt: time.Now().UTC(),
-		ExpiresAt: exp,
-	}
-	cs = append(cs, c)
-
-	if err := a.saveClients(cs); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	if err := a.writeServerState(st); err != nil {
-		http.Error(w, err.Error(), 500)
+	c := store.Client{
+		ID:         makeID(),
+		Name:       name,
+		PublicKey:  pub.String(),
+		PrivateKey: priv.String(),
+		Address:    addr,
+		CreatedAt:  time.Now().UTC(),
+		ExpiresAt:  exp,
+	}
+
+	if err := a.db.CreateClient(r.Context(), c, st); err != nil {
+		_ = a.alloc.Release(addr)
+		switch {
+		case errors.Is(err, store.ErrAddressTaken), errors.Is(err, store.ErrPublicKeyUsed):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), 500)
+		}
 		return
 	}
-	if err := a.applyServerConfig(st, cs); err != nil {
+
+	if err := a.applyServerConfig(r.Context(), st); err != nil {
 		http.Error(w, "apply failed: "+err.Error(), 500)
 		return
 	}
@@ -374,116 +404,46 @@ func (a *app) createClient(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(toPublic(c))
 }
 
-func allocateNextAddress(st *serverState) (string, error) {
-	ip, ipnet, err := net.ParseCIDR(st.SubnetCIDR)
-	if err != nil {
-		return "", err
-	}
-	_ = ip
-
-	// This allocator supports only IPv4 /24..../16 style simply via host index within last octets.
-	// It increments st.NextHost and returns /32 address.
-	// For your use-case (defaults) this is fine; can be extended later.
-
-	base := ipnet.IP.To4()
-	if base == nil {
-		return "", errors.New("only IPv4 subnet supported")
-	}
-
-	// Compute candidate IP by setting last octet to NextHost for /24.
-	// If subnet is not /24, this is simplistic; you can later extend.
-	maskOnes, _ := ipnet.Mask.Size()
-	if maskOnes != 24 {
-		return "", fmt.Errorf("subnet %s: only /24 supported by allocator currently", st.SubnetCIDR)
-	}
-	if st.NextHost < 2 || st.NextHost > 254 {
-		return "", errors.New("address pool exhausted")
-	}
-
-	cand := net.IPv4(base[0], base[1], base[2], byte(st.NextHost))
-	if cand.String() == st.ServerIP {
-		st.NextHost++
-		cand = net.IPv4(base[0], base[1], base[2], byte(st.NextHost))
-	}
-	addr := cand.String() + "/32"
-	st.NextHost++
-	return addr, nil
-}
-
 func (a *app) deleteClient(w http.ResponseWriter, r *http.Request, id string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	st, err := a.readServerState()
+	st, err := a.db.GetServerState(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	cs, err := a.loadClients()
+	c, err := a.db.GetClient(r.Context(), id)
 	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "not found", 404)
+			return
+		}
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	out := make([]client, 0, len(cs))
-	found := false
-	for _, c := range cs {
-		if c.ID == id {
-			found = true
-			continue
+	if err := a.db.DeleteClient(r.Context(), id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "not found", 404)
+			return
 		}
-		out = append(out, c)
-	}
-	if !found {
-		http.Error(w, "not found", 404)
-		return
-	}
-
-	if err := a.saveClients(out); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
-	if err := a.applyServerConfig(st, out); err != nil {
+	if err := a.alloc.Release(c.Address); err != nil {
+		log.Printf("releasing address %q for deleted client %s: %v", c.Address, id, err)
+	}
+
+	if err := a.applyServerConfig(r.Context(), st); err != nil {
 		http.Error(w, "apply failed: "+err.Error(), 500)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (a *app) applyServerConfig(st serverState, cs []client) error {
-	var b strings.Builder
-	b.WriteString("[Interface]\n")
-	b.WriteString("PrivateKey = " + st.ServerPrivateKey + "\n")
-	b.WriteString(fmt.Sprintf("ListenPort = %d\n", a.port))
-	b.WriteString("\n")
-
-	now := time.Now()
-	for _, c := range cs {
-		if c.ExpiresAt != nil && now.After(*c.ExpiresAt) {
-			continue
-		}
-		b.WriteString("[Peer]\n")
-		b.WriteString("PublicKey = " + c.PublicKey + "\n")
-		ipOnly := strings.Split(c.Address, "/")[0]
-		b.WriteString("AllowedIPs = " + ipOnly + "/32\n")
-		b.WriteString("\n")
-	}
-
-	confPath := filepath.Join(a.dataDir, a.iface+".conf")
-	if err := os.WriteFile(confPath, []byte(b.String()), 0o600); err != nil {
-		return err
-	}
-
-	cmd := exec.Command("awg", "setconf", a.iface, confPath)
-	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
-	return cmd.Run()
-}
-
 func (a *app) downloadConfig(w http.ResponseWriter, r *http.Request, id string) {
-	c, st, err := a.findClientAndState(id)
+	c, st, err := a.findClientAndState(r.Context(), id)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
+		if errors.Is(err, store.ErrNotFound) {
 			http.Error(w, "not found", 404)
 			return
 		}
@@ -505,10 +465,30 @@ func (a *app) downloadConfig(w http.ResponseWriter, r *http.Request, id string)
 	w.Write([]byte(cfg))
 }
 
+// writeTokenErr maps a store token lookup/consume error to the matching
+// HTTP status, shared between the pre-consume QR/PNG size check and the
+// actual token consumption.
+func writeTokenErr(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		http.Error(w, "not found", 404)
+	case errors.Is(err, store.ErrTokenUsed), errors.Is(err, store.ErrTokenExpired):
+		http.Error(w, "gone", http.StatusGone)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// dlFormats are the download formats handleDownloadToken understands, beyond
+// the default plain .conf: "qr" for an HTML landing page with the code
+// inline, "png" for the bare QR image.
+var dlFormats = map[string]bool{"": true, "qr": true, "png": true}
+
 func (a *app) createOneTimeLink(w http.ResponseWriter, r *http.Request, id string) {
-	// request: {"ttlSeconds": 3600} optional
+	// request: {"ttlSeconds": 3600, "format": "qr"}, both optional
 	type req struct {
-		TTLSeconds *int `json:"ttlSeconds"`
+		TTLSeconds *int    `json:"ttlSeconds"`
+		Format     *string `json:"format"`
 	}
 	var q req
 	_ = json.NewDecoder(r.Body).Decode(&q)
@@ -516,51 +496,38 @@ func (a *app) createOneTimeLink(w http.ResponseWriter, r *http.Request, id strin
 	if q.TTLSeconds != nil && *q.TTLSeconds > 0 {
 		ttl = *q.TTLSeconds
 	}
-
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	// validate client exists
-	cs, err := a.loadClients()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-	found := false
-	for _, c := range cs {
-		if c.ID == id {
-			found = true
-			break
+	format := ""
+	if q.Format != nil {
+		format = strings.TrimSpace(*q.Format)
+		if !dlFormats[format] {
+			http.Error(w, "format must be qr or png", 400)
+			return
 		}
 	}
-	if !found {
-		http.Error(w, "not found", 404)
-		return
-	}
 
-	ts, err := a.loadTokens()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	token := randomToken(32)
-	t := dlToken{
-		Token:     token,
+	t := store.DLToken{
+		Token:     randomToken(32),
 		ClientID:  id,
 		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second).UTC(),
 		Used:      false,
 	}
-	ts = append(ts, t)
-	if err := a.saveTokens(ts); err != nil {
+	if err := a.db.CreateOneTimeLink(r.Context(), t); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "not found", 404)
+			return
+		}
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	// You can place UI behind HTTPS; link will be https://<host>/dl/<token>
+	urlPath := "/dl/" + t.Token
+	if format != "" {
+		urlPath += "?format=" + format
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]any{
-		"urlPath":   "/dl/" + token,
+		"urlPath":   urlPath,
 		"expiresAt": t.ExpiresAt.Format(time.RFC3339),
 	})
 }
@@ -576,46 +543,43 @@ func (a *app) handleDownloadToken(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "not found", 404)
 		return
 	}
-
-	a.mu.Lock()
-	defer a.mu.Unlock()
-
-	ts, err := a.loadTokens()
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+	format := r.URL.Query().Get("format")
+	if !dlFormats[format] {
+		http.Error(w, "format must be qr or png", 400)
 		return
 	}
 
-	idx := -1
-	for i := range ts {
-		if ts[i].Token == token {
-			idx = i
-			break
+	// For qr/png, check the rendered config actually fits in a QR code
+	// before spending the token's single use — otherwise a too-large
+	// config would burn the link on a 422 and leave nothing else to fetch
+	// it with.
+	if format == "qr" || format == "png" {
+		c, st, err := a.db.PeekDownloadToken(r.Context(), token)
+		if err != nil {
+			writeTokenErr(w, err)
+			return
+		}
+		if c.ExpiresAt != nil && time.Now().After(*c.ExpiresAt) {
+			http.Error(w, "expired", http.StatusGone)
+			return
+		}
+		cfg, err := a.renderClientConfig(c, st)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		if _, err := renderConfigQR(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
 		}
-	}
-	if idx < 0 {
-		http.Error(w, "not found", 404)
-		return
-	}
-	if ts[idx].Used {
-		http.Error(w, "gone", http.StatusGone)
-		return
-	}
-	if time.Now().After(ts[idx].ExpiresAt) {
-		http.Error(w, "gone", http.StatusGone)
-		return
-	}
-
-	// mark used
-	ts[idx].Used = true
-	if err := a.saveTokens(ts); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
 	}
 
-	c, st, err := a.findClientAndState(ts[idx].ClientID)
+	// The token is consumed here regardless of format, so a landing page
+	// (format=qr) must carry everything the user needs inline: it's the
+	// one and only successful fetch this token will ever serve.
+	c, st, err := a.db.ConsumeDownloadToken(r.Context(), token)
 	if err != nil {
-		http.Error(w, "not found", 404)
+		writeTokenErr(w, err)
 		return
 	}
 	if c.ExpiresAt != nil && time.Now().After(*c.ExpiresAt) {
@@ -628,33 +592,37 @@ func (a *app) handleDownloadToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.conf"`, sanitize(c.Name)))
-	w.Write([]byte(cfg))
+	filename := sanitize(c.Name)
+	switch format {
+	case "qr":
+		writeConfigQRPage(w, filename, cfg)
+	case "png":
+		writeConfigPNG(w, filename, cfg)
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.conf"`, filename))
+		w.Write([]byte(cfg))
+	}
 }
 
-func (a *app) findClientAndState(id string) (client, serverState, error) {
-	st, err := a.readServerState()
+func (a *app) findClientAndState(ctx context.Context, id string) (store.Client, store.ServerState, error) {
+	st, err := a.db.GetServerState(ctx)
 	if err != nil {
-		return client{}, st, err
+		return store.Client{}, st, err
 	}
-	cs, err := a.loadClients()
+	c, err := a.db.GetClient(ctx, id)
 	if err != nil {
-		return client{}, st, err
-	}
-	for _, c := range cs {
-		if c.ID == id {
-			return c, st, nil
-		}
+		return store.Client{}, st, err
 	}
-	return client{}, st, os.ErrNotExist
+	return c, st, nil
 }
 
-func (a *app) renderClientConfig(c client, st serverState) (string, error) {
+func (a *app) renderClientConfig(c store.Client, st store.ServerState) (string, error) {
 	var b strings.Builder
 	b.WriteString("[Interface]\n")
-	b.WriteString("PrivateKey = " + c.PrivKey + "\n")
+	b.WriteString("PrivateKey = " + c.PrivateKey + "\n")
 	b.WriteString("Address = " + c.Address + "\n")
+	renderObfuscationInto(st.Obfuscation, &b)
 
 	// extra lines (DPI/obfuscation/etc) — provided by installer, no defaults.
 	extra := filepath.Join(a.dataDir, "client-extra-interface.txt")
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerCounters reconstructs a monotonic running total for a peer's rx/tx
+// bytes across successive /metrics polls, since the kernel's own counters
+// reset to zero whenever a peer is removed and re-added (e.g. on key
+// rotation or a netlink reconfiguration that dropped and re-added it).
+type peerCounters struct {
+	lastRX, lastTX   uint64
+	totalRX, totalTX uint64
+}
+
+// metricsCollector holds per-peer counter state across the process lifetime
+// of app, keyed by client ID rather than public key so the running total
+// survives a key rotation.
+type metricsCollector struct {
+	mu    sync.Mutex
+	peers map[string]*peerCounters
+}
+
+func newMetricsCollector() *metricsCollector {
+	return &metricsCollector{peers: make(map[string]*peerCounters)}
+}
+
+// observe folds in the latest cumulative rx/tx wgctrl reported for clientID
+// and returns the running totals to export. If rx or tx is lower than the
+// last observed value, the peer's kernel-side counters were reset, and the
+// new value is treated as pure gain rather than a decrease.
+func (m *metricsCollector) observe(clientID string, rx, tx uint64) (totalRX, totalTX uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.peers[clientID]
+	if !ok {
+		p = &peerCounters{}
+		m.peers[clientID] = p
+	}
+	if rx >= p.lastRX {
+		p.totalRX += rx - p.lastRX
+	} else {
+		p.totalRX += rx
+	}
+	if tx >= p.lastTX {
+		p.totalTX += tx - p.lastTX
+	} else {
+		p.totalTX += tx
+	}
+	p.lastRX, p.lastTX = rx, tx
+	return p.totalRX, p.totalTX
+}
+
+// peek returns clientID's running totals without folding in a new sample.
+// Used when wgctrl couldn't report a live rx/tx for this poll (device query
+// failed, or the peer is momentarily absent from the device), so a transient
+// gap doesn't get treated as a drop to zero and double-count on the next
+// successful poll.
+func (m *metricsCollector) peek(clientID string) (totalRX, totalTX uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.peers[clientID]
+	if !ok {
+		return 0, 0
+	}
+	return p.totalRX, p.totalTX
+}
+
+// handleMetrics exposes per-peer traffic and handshake state in Prometheus
+// text exposition format, gated by METRICS_SECRET (falling back to the admin
+// token so a fresh install doesn't need a second secret configured). The
+// exposition format itself is rendered by VictoriaMetrics/metrics rather than
+// hand-built, so escaping and the exposition header are handled by a library
+// instead of ad hoc string formatting.
+func (a *app) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	got := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if subtle.ConstantTimeCompare([]byte(got), []byte(a.metricsSecret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cs, err := a.db.ListClients(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	outstanding, err := a.db.CountOutstandingTokens(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	peers := make(map[wgtypes.Key]wgtypes.Peer)
+	if a.wg != nil {
+		if dev, err := a.wg.Device(a.iface); err != nil {
+			log.Printf("metrics: query device %s: %v", a.iface, err)
+		} else {
+			for _, p := range dev.Peers {
+				peers[p.PublicKey] = p
+			}
+		}
+	}
+
+	// A fresh Set per request, rather than the process-wide default, so a
+	// client removed between polls simply stops being written instead of
+	// lingering in global registry state.
+	set := metrics.NewSet()
+
+	now := time.Now()
+	var expired int
+	for _, c := range cs {
+		if c.ExpiresAt != nil && now.After(*c.ExpiresAt) {
+			expired++
+		}
+
+		key, err := wgtypes.ParseKey(c.PublicKey)
+		if err != nil {
+			continue
+		}
+		p, ok := peers[key]
+		var totalRX, totalTX uint64
+		if ok {
+			totalRX, totalTX = a.metrics.observe(c.ID, uint64(p.ReceiveBytes), uint64(p.TransmitBytes))
+		} else {
+			totalRX, totalTX = a.metrics.peek(c.ID)
+		}
+
+		labels := fmt.Sprintf(`client_id=%q,client_name=%q`, c.ID, c.Name)
+		set.GetOrCreateCounter(fmt.Sprintf("awg_peer_rx_bytes_total{%s}", labels)).Set(totalRX)
+		set.GetOrCreateCounter(fmt.Sprintf("awg_peer_tx_bytes_total{%s}", labels)).Set(totalTX)
+		if ok && !p.LastHandshakeTime.IsZero() {
+			handshake := float64(p.LastHandshakeTime.Unix())
+			set.GetOrCreateGauge(fmt.Sprintf("awg_peer_last_handshake_seconds{%s}", labels), func() float64 { return handshake })
+		}
+		if ok && p.Endpoint != nil {
+			set.GetOrCreateGauge(fmt.Sprintf("awg_peer_endpoint_info{%s,endpoint=%q}", labels, p.Endpoint.String()), func() float64 { return 1 })
+		}
+	}
+
+	nClients, nExpired, nOutstanding := float64(len(cs)), float64(expired), float64(outstanding)
+	set.GetOrCreateGauge("awg_clients_total", func() float64 { return nClients })
+	set.GetOrCreateGauge("awg_clients_expired_total", func() float64 { return nExpired })
+	set.GetOrCreateGauge("awg_dl_tokens_outstanding", func() float64 { return nOutstanding })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	set.WritePrometheus(w)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/OxCom/amneziawg/server/src/store"
+)
+
+// renderObfuscationInto writes the non-zero junk/header lines for o into b,
+// matching the order AmneziaWG expects them in an [Interface] section.
+func renderObfuscationInto(o store.ObfuscationParams, b *strings.Builder) {
+	if o.IsZero() {
+		return
+	}
+	if o.Jc != 0 {
+		fmt.Fprintf(b, "Jc = %d\n", o.Jc)
+	}
+	if o.Jmin != 0 {
+		fmt.Fprintf(b, "Jmin = %d\n", o.Jmin)
+	}
+	if o.Jmax != 0 {
+		fmt.Fprintf(b, "Jmax = %d\n", o.Jmax)
+	}
+	if o.S1 != 0 {
+		fmt.Fprintf(b, "S1 = %d\n", o.S1)
+	}
+	if o.S2 != 0 {
+		fmt.Fprintf(b, "S2 = %d\n", o.S2)
+	}
+	if o.H1 != 0 {
+		fmt.Fprintf(b, "H1 = %d\n", o.H1)
+	}
+	if o.H2 != 0 {
+		fmt.Fprintf(b, "H2 = %d\n", o.H2)
+	}
+	if o.H3 != 0 {
+		fmt.Fprintf(b, "H3 = %d\n", o.H3)
+	}
+	if o.H4 != 0 {
+		fmt.Fprintf(b, "H4 = %d\n", o.H4)
+	}
+}
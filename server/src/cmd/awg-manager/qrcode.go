@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// qrMaxConfigBytes is go-qrcode's byte-mode ceiling at low error correction
+// (a version-40 QR holds ~2953 bytes in byte mode). AmneziaWG's junk/header
+// lines push a real config close enough to this that it's worth refusing up
+// front with a clear message instead of letting Encode fail deep inside.
+const qrMaxConfigBytes = 2953
+
+func renderConfigQR(cfg string) ([]byte, error) {
+	if len(cfg) > qrMaxConfigBytes {
+		return nil, fmt.Errorf("config is %d bytes, too large to encode as a single QR code (limit %d)", len(cfg), qrMaxConfigBytes)
+	}
+	return qrcode.Encode(cfg, qrcode.Low, 320)
+}
+
+// writeConfigPNG renders cfg as a standalone QR code PNG.
+func writeConfigPNG(w http.ResponseWriter, filename, cfg string) {
+	png, err := renderConfigQR(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.png"`, filename))
+	w.Write(png)
+}
+
+// writeConfigQRPage renders an HTML landing page with the QR code inline and
+// a download link for the raw .conf, both embedded as data URIs. The token
+// backing this page is already consumed by the single GET that served it, so
+// there's no second request available to fetch the file — it has to be
+// self-contained.
+func writeConfigQRPage(w http.ResponseWriter, filename, cfg string) {
+	png, err := renderConfigQR(cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	qrDataURI := "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	cfgDataURI := "data:text/plain;base64," + base64.StdEncoding.EncodeToString([]byte(cfg))
+
+	var b strings.Builder
+	b.WriteString("<!doctype html><html><head><meta charset=\"utf-8\"><title>WireGuard config</title></head><body>\n")
+	fmt.Fprintf(&b, "<img src=%q alt=\"WireGuard config QR code\">\n", qrDataURI)
+	fmt.Fprintf(&b, "<p><a download=\"%s.conf\" href=%q>Download %s.conf</a></p>\n", filename, cfgDataURI, filename)
+	b.WriteString("</body></html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
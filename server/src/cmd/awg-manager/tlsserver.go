@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/errgroup"
+)
+
+// serve runs the plain HTTP listener and, when TLS is configured via either
+// -tls-cert/-tls-key or -acme-domains, an HTTPS listener alongside it. Both
+// are shut down cleanly on SIGTERM/SIGINT. Previously main unconditionally
+// served plain HTTP, which meant /dl/<token> links could only be handed to
+// end users over cleartext.
+func (a *app) serve(mux *http.ServeMux, listen, listenTLS, tlsCert, tlsKey, acmeDomains, acmeEmail, acmeCache string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	var tlsConfig *tls.Config
+	var acmeManager *autocert.Manager
+	httpHandler := http.Handler(mux)
+
+	switch {
+	case acmeDomains != "":
+		if listenTLS == "" {
+			return fmt.Errorf("-acme-domains requires -listen-tls")
+		}
+		if acmeCache == "" {
+			acmeCache = filepath.Join(a.dataDir, "acme-cache")
+		}
+		if err := os.MkdirAll(acmeCache, 0o700); err != nil {
+			return fmt.Errorf("acme cache dir: %w", err)
+		}
+		domains := strings.Split(acmeDomains, ",")
+		for i := range domains {
+			domains[i] = strings.TrimSpace(domains[i])
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(acmeCache),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      acmeEmail,
+		}
+		acmeManager = m
+		tlsConfig = m.TLSConfig()
+		httpHandler = redirectToHTTPS(listenTLS)
+	case tlsCert != "" || tlsKey != "":
+		if listenTLS == "" {
+			return fmt.Errorf("-tls-cert/-tls-key require -listen-tls")
+		}
+		if tlsCert == "" || tlsKey == "" {
+			return fmt.Errorf("-tls-cert and -tls-key must both be set")
+		}
+		httpHandler = redirectToHTTPS(listenTLS)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	// Let's Encrypt's HTTP-01 validator only ever dials port 80 of the
+	// domain, so the challenge responder needs its own :80 listener
+	// independent of -listen (which defaults to :8080). If -listen already
+	// is :80, reuse that single listener instead of double-binding the port.
+	const acmeHTTPAddr = ":80"
+	if acmeManager != nil {
+		acmeHandler := acmeManager.HTTPHandler(httpHandler)
+		if portOf(listen) == portOf(acmeHTTPAddr) {
+			httpHandler = acmeHandler
+		} else {
+			acmeSrv := &http.Server{Addr: acmeHTTPAddr, Handler: acmeHandler}
+			g.Go(func() error {
+				log.Printf("listening on %s (acme http-01)", acmeHTTPAddr)
+				return serveAndShutdown(ctx, acmeSrv, acmeSrv.ListenAndServe)
+			})
+		}
+	}
+
+	httpSrv := &http.Server{Addr: listen, Handler: httpHandler}
+	g.Go(func() error {
+		log.Printf("listening on %s", listen)
+		return serveAndShutdown(ctx, httpSrv, httpSrv.ListenAndServe)
+	})
+
+	if listenTLS != "" {
+		httpsSrv := &http.Server{Addr: listenTLS, Handler: mux, TLSConfig: tlsConfig}
+		g.Go(func() error {
+			log.Printf("listening on %s (tls)", listenTLS)
+			if tlsConfig != nil {
+				return serveAndShutdown(ctx, httpsSrv, func() error { return httpsSrv.ListenAndServeTLS("", "") })
+			}
+			return serveAndShutdown(ctx, httpsSrv, func() error { return httpsSrv.ListenAndServeTLS(tlsCert, tlsKey) })
+		})
+	}
+
+	return g.Wait()
+}
+
+// serveAndShutdown runs listenAndServe until it returns, but also shuts srv
+// down as soon as ctx is cancelled, so a listener still blocked in Accept
+// doesn't keep the process from exiting on SIGTERM.
+func serveAndShutdown(ctx context.Context, srv *http.Server, listenAndServe func() error) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- listenAndServe() }()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
+// portOf extracts the port from a listen address (e.g. "80" from ":80" or
+// "0.0.0.0:80"), or "" if addr doesn't parse as host:port.
+func portOf(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// redirectToHTTPS sends every request to the same host on listenTLS's port,
+// preserving path and query.
+func redirectToHTTPS(listenTLS string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(listenTLS)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := "https://" + host
+		if tlsPort != "" && tlsPort != "443" {
+			target += ":" + tlsPort
+		}
+		target += r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
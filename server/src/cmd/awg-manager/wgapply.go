@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"github.com/OxCom/amneziawg/server/src/store"
+)
+
+// applyServerConfig pushes st onto the live interface against the
+// current client list. It holds applyMu for the whole read-diff-apply
+// sequence and re-lists clients from the DB itself (rather than trusting a
+// list snapshotted by the caller before acquiring the lock), so that
+// whichever concurrent create/delete request applies last always pushes the
+// true latest state — two callers can no longer race a stale snapshot past
+// a fresher one and leave the live interface diverged from the DB.
+//
+// It prefers an in-process netlink reconfiguration (no fork, no brief peer
+// drop) and only falls back to shelling out to `awg setconf` when that isn't
+// possible: no wgctrl handle, or an AmneziaWG junk profile is in play that
+// the generic wgtypes attributes can't carry yet.
+func (a *app) applyServerConfig(ctx context.Context, st store.ServerState) error {
+	a.applyMu.Lock()
+	defer a.applyMu.Unlock()
+
+	cs, err := a.db.ListClients(ctx)
+	if err != nil {
+		return fmt.Errorf("list clients: %w", err)
+	}
+
+	if a.wg != nil && st.Obfuscation.IsZero() {
+		if err := a.applyViaNetlink(st, cs); err != nil {
+			log.Printf("netlink reconfiguration of %s failed, falling back to awg setconf: %v", a.iface, err)
+		} else {
+			return nil
+		}
+	}
+	return a.applyViaShellOut(st, cs)
+}
+
+// applyViaNetlink reconciles the live device's peer set with cs by computing
+// an add/remove diff and pushing only that diff through ConfigureDevice with
+// ReplacePeers=false, so unrelated peers are never touched.
+func (a *app) applyViaNetlink(st store.ServerState, cs []store.Client) error {
+	dev, err := a.wg.Device(a.iface)
+	if err != nil {
+		return fmt.Errorf("query device %s: %w", a.iface, err)
+	}
+
+	now := time.Now()
+	desired := make(map[wgtypes.Key]store.Client, len(cs))
+	for _, c := range cs {
+		if c.ExpiresAt != nil && now.After(*c.ExpiresAt) {
+			continue
+		}
+		key, err := wgtypes.ParseKey(c.PublicKey)
+		if err != nil {
+			return fmt.Errorf("client %s: invalid public key: %w", c.ID, err)
+		}
+		desired[key] = c
+	}
+
+	var peers []wgtypes.PeerConfig
+	onDevice := make(map[wgtypes.Key]wgtypes.Peer, len(dev.Peers))
+	for _, p := range dev.Peers {
+		onDevice[p.PublicKey] = p
+		if _, ok := desired[p.PublicKey]; !ok {
+			peers = append(peers, wgtypes.PeerConfig{PublicKey: p.PublicKey, Remove: true})
+		}
+	}
+	for key, c := range desired {
+		allowed, err := peerAllowedIPs(c.Address)
+		if err != nil {
+			return fmt.Errorf("client %s: %w", c.ID, err)
+		}
+		if p, ok := onDevice[key]; ok && len(p.AllowedIPs) == len(allowed) {
+			same := true
+			for i := range allowed {
+				if p.AllowedIPs[i].String() != allowed[i].String() {
+					same = false
+					break
+				}
+			}
+			if same {
+				continue
+			}
+		}
+		peers = append(peers, wgtypes.PeerConfig{
+			PublicKey:         key,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        allowed,
+		})
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+
+	priv, err := wgtypes.ParseKey(st.ServerPrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid server private key: %w", err)
+	}
+	port := a.port
+
+	return a.wg.ConfigureDevice(a.iface, wgtypes.Config{
+		PrivateKey:   &priv,
+		ListenPort:   &port,
+		ReplacePeers: false,
+		Peers:        peers,
+	})
+}
+
+// peerAllowedIPs parses a client's Address field — "10.8.0.2/32" or, when
+// dual-stack is enabled, "10.8.0.2/32, fd00:8::2/128" — into the AllowedIPs
+// netlink wants for that peer.
+func peerAllowedIPs(address string) ([]net.IPNet, error) {
+	var out []net.IPNet
+	for _, part := range strings.Split(address, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %w", part, err)
+		}
+		out = append(out, net.IPNet{IP: ip, Mask: ipnet.Mask})
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no addresses in %q", address)
+	}
+	return out, nil
+}
+
+// applyViaShellOut renders a full wg-quick style .conf and reloads the whole
+// interface with `awg setconf`. It is the only path that can express the
+// AmneziaWG junk/header attributes today, and the safety net for hosts where
+// wgctrl can't open the device at all.
+func (a *app) applyViaShellOut(st store.ServerState, cs []store.Client) error {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	b.WriteString("PrivateKey = " + st.ServerPrivateKey + "\n")
+	fmt.Fprintf(&b, "ListenPort = %d\n", a.port)
+	renderObfuscationInto(st.Obfuscation, &b)
+	b.WriteString("\n")
+
+	now := time.Now()
+	for _, c := range cs {
+		if c.ExpiresAt != nil && now.After(*c.ExpiresAt) {
+			continue
+		}
+		b.WriteString("[Peer]\n")
+		b.WriteString("PublicKey = " + c.PublicKey + "\n")
+		b.WriteString("AllowedIPs = " + c.Address + "\n")
+		b.WriteString("\n")
+	}
+
+	confPath := filepath.Join(a.dataDir, a.iface+".conf")
+	if err := os.WriteFile(confPath, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("awg", "setconf", a.iface, confPath)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
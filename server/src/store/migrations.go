@@ -0,0 +1,138 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is one numbered step of the schema: each migration runs at most
+// once, in order, tracked by version in schema_migrations.
+type migration struct {
+	version int
+	stmts   []string
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		stmts: []string{
+			`CREATE TABLE server_state (
+				id INTEGER PRIMARY KEY CHECK (id = 1),
+				server_private_key TEXT NOT NULL,
+				server_public_key TEXT NOT NULL,
+				subnet_cidr TEXT NOT NULL,
+				server_ip TEXT NOT NULL,
+				next_host INTEGER NOT NULL,
+				obfuscation_jc INTEGER NOT NULL DEFAULT 0,
+				obfuscation_jmin INTEGER NOT NULL DEFAULT 0,
+				obfuscation_jmax INTEGER NOT NULL DEFAULT 0,
+				obfuscation_s1 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_s2 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h1 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h2 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h3 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h4 INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE clients (
+				id TEXT PRIMARY KEY,
+				name TEXT NOT NULL,
+				public_key TEXT NOT NULL UNIQUE,
+				private_key TEXT NOT NULL,
+				address TEXT NOT NULL UNIQUE,
+				created_at TEXT NOT NULL,
+				expires_at TEXT,
+				has_obfuscation_override INTEGER NOT NULL DEFAULT 0,
+				obfuscation_jc INTEGER NOT NULL DEFAULT 0,
+				obfuscation_jmin INTEGER NOT NULL DEFAULT 0,
+				obfuscation_jmax INTEGER NOT NULL DEFAULT 0,
+				obfuscation_s1 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_s2 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h1 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h2 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h3 INTEGER NOT NULL DEFAULT 0,
+				obfuscation_h4 INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE dl_tokens (
+				token TEXT PRIMARY KEY,
+				client_id TEXT NOT NULL REFERENCES clients(id) ON DELETE CASCADE,
+				expires_at TEXT NOT NULL,
+				used INTEGER NOT NULL DEFAULT 0
+			)`,
+			`CREATE TABLE audit_log (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				at TEXT NOT NULL,
+				action TEXT NOT NULL,
+				details TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 2,
+		stmts: []string{
+			`ALTER TABLE server_state ADD COLUMN subnet_cidr6 TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE server_state ADD COLUMN server_ip6 TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		// Per-client obfuscation overrides never actually reached the live
+		// interface (Jc/Jmin/Jmax/S1/S2/H1-4 are [Interface]-level handshake
+		// parameters server and client must agree on exactly, and both the
+		// netlink and awg-setconf apply paths only ever pushed the
+		// server-wide server_state.obfuscation_* profile). A client given an
+		// override got a downloaded config that silently disagreed with what
+		// the server actually ran. Obfuscation is a single server-wide
+		// profile; drop the per-client columns rather than keep a knob that
+		// doesn't work.
+		version: 3,
+		stmts: []string{
+			`ALTER TABLE clients DROP COLUMN has_obfuscation_override`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_jc`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_jmin`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_jmax`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_s1`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_s2`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_h1`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_h2`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_h3`,
+			`ALTER TABLE clients DROP COLUMN obfuscation_h4`,
+		},
+	},
+}
+
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now'))
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range m.stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", m.version, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, m.version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: record version: %w", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: commit: %w", m.version, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package store
+
+import "fmt"
+
+// ObfuscationParams holds the AmneziaWG junk/header obfuscation knobs that
+// used to live in an opaque client-extra-interface.txt blob. The zero value
+// means "no obfuscation configured".
+type ObfuscationParams struct {
+	Jc   int    `json:"jc,omitempty"`
+	Jmin int    `json:"jmin,omitempty"`
+	Jmax int    `json:"jmax,omitempty"`
+	S1   int    `json:"s1,omitempty"`
+	S2   int    `json:"s2,omitempty"`
+	H1   uint32 `json:"h1,omitempty"`
+	H2   uint32 `json:"h2,omitempty"`
+	H3   uint32 `json:"h3,omitempty"`
+	H4   uint32 `json:"h4,omitempty"`
+}
+
+func (o ObfuscationParams) IsZero() bool {
+	return o == ObfuscationParams{}
+}
+
+// Wire sizes of the two WireGuard handshake messages S1/S2 pad, per the
+// upstream AmneziaWG handshake invariant below.
+const (
+	messageInitiationSize = 148
+	messageResponseSize   = 92
+)
+
+// Validate checks the invariants AmneziaWG itself enforces: Jmin must not
+// exceed Jmax, S1+messageInitiationSize must not equal S2+messageResponseSize
+// (otherwise a junked initiation and a junked response land on the same
+// wire size, which is exactly the fingerprint S1/S2 exist to break), and the
+// four magic header values must be pairwise distinct so peers can tell
+// message types apart.
+func (o ObfuscationParams) Validate() error {
+	if o.IsZero() {
+		return nil
+	}
+	if o.Jc < 0 || o.Jmin < 0 || o.Jmax < 0 || o.S1 < 0 || o.S2 < 0 {
+		return fmt.Errorf("obfuscation: Jc, Jmin, Jmax, S1, S2 must be non-negative")
+	}
+	if o.Jmin > o.Jmax {
+		return fmt.Errorf("obfuscation: Jmin (%d) must be <= Jmax (%d)", o.Jmin, o.Jmax)
+	}
+	if o.S1+messageInitiationSize == o.S2+messageResponseSize {
+		return fmt.Errorf("obfuscation: S1+%d must not equal S2+%d (handshake initiation/response would collide on wire size)", messageInitiationSize, messageResponseSize)
+	}
+	headers := []uint32{o.H1, o.H2, o.H3, o.H4}
+	for i := range headers {
+		for j := i + 1; j < len(headers); j++ {
+			if headers[i] == headers[j] {
+				return fmt.Errorf("obfuscation: H1..H4 must be pairwise distinct, H%d and H%d both %d", i+1, j+1, headers[i])
+			}
+		}
+	}
+	return nil
+}
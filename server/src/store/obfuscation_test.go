@@ -0,0 +1,68 @@
+package store
+
+import "testing"
+
+func TestObfuscationParamsIsZeroAllowsAnything(t *testing.T) {
+	if err := (ObfuscationParams{}).Validate(); err != nil {
+		t.Fatalf("Validate() on the zero value = %v, want nil", err)
+	}
+}
+
+func TestObfuscationParamsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		o       ObfuscationParams
+		wantErr bool
+	}{
+		{
+			name:    "valid profile",
+			o:       ObfuscationParams{Jc: 3, Jmin: 10, Jmax: 20, S1: 1, S2: 2, H1: 1, H2: 2, H3: 3, H4: 4},
+			wantErr: false,
+		},
+		{
+			name:    "negative Jc",
+			o:       ObfuscationParams{Jc: -1, H1: 1, H2: 2, H3: 3, H4: 4},
+			wantErr: true,
+		},
+		{
+			name:    "negative S1",
+			o:       ObfuscationParams{S1: -1, H1: 1, H2: 2, H3: 3, H4: 4},
+			wantErr: true,
+		},
+		{
+			name:    "Jmin exceeds Jmax",
+			o:       ObfuscationParams{Jmin: 20, Jmax: 10, H1: 1, H2: 2, H3: 3, H4: 4},
+			wantErr: true,
+		},
+		{
+			// messageInitiationSize - messageResponseSize == 56, so
+			// S2 == S1+56 lands exactly on the forbidden wire-size collision.
+			name:    "S2 offset from S1 by the init/response size delta collides",
+			o:       ObfuscationParams{S1: 10, S2: 10 + (messageInitiationSize - messageResponseSize), H1: 1, H2: 2, H3: 3, H4: 4},
+			wantErr: true,
+		},
+		{
+			name:    "S1 equal S2 does not collide",
+			o:       ObfuscationParams{S1: 10, S2: 10, H1: 1, H2: 2, H3: 3, H4: 4},
+			wantErr: false,
+		},
+		{
+			name:    "S2 one short of the collision is fine",
+			o:       ObfuscationParams{S1: 10, S2: 10 + (messageInitiationSize - messageResponseSize) - 1, H1: 1, H2: 2, H3: 3, H4: 4},
+			wantErr: false,
+		},
+		{
+			name:    "duplicate headers",
+			o:       ObfuscationParams{H1: 7, H2: 7, H3: 3, H4: 4},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.o.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate(%+v) error = %v, wantErr %v", tt.o, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+// Package store persists server state, clients, and one-time download
+// tokens in a single embedded SQLite database. It replaces the previous
+// server.json/clients.json/dl-tokens.json trio, which were re-read,
+// re-marshalled, and rewritten whole under a single global mutex with no
+// atomicity across the three files and no history of what changed.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var (
+	ErrNotFound      = errors.New("store: not found")
+	ErrTokenUsed     = errors.New("store: token already used")
+	ErrTokenExpired  = errors.New("store: token expired")
+	ErrAddressTaken  = errors.New("store: address already allocated")
+	ErrPublicKeyUsed = errors.New("store: public key already registered")
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating if necessary) the SQLite database at path and brings
+// its schema up to date via the migration runner.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1) // sqlite + WAL: one writer, migrations assume serialized access
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error { return s.db.Close() }
+
+func (s *Store) withTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func classifyConstraintErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "clients.address"):
+		return ErrAddressTaken
+	case strings.Contains(msg, "clients.public_key"):
+		return ErrPublicKeyUsed
+	default:
+		return err
+	}
+}
+
+// EnsureServerState returns the existing server_state row, or seeds it with
+// seed (e.g. a freshly generated keypair) if no row exists yet.
+func (s *Store) EnsureServerState(ctx context.Context, seed ServerState) (ServerState, error) {
+	st, err := s.GetServerState(ctx)
+	if err == nil {
+		return st, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return ServerState{}, err
+	}
+	if err := s.SaveServerState(ctx, seed); err != nil {
+		return ServerState{}, err
+	}
+	return seed, nil
+}
+
+const serverStateColumns = `server_private_key, server_public_key, subnet_cidr, server_ip, next_host,
+	subnet_cidr6, server_ip6,
+	obfuscation_jc, obfuscation_jmin, obfuscation_jmax, obfuscation_s1, obfuscation_s2,
+	obfuscation_h1, obfuscation_h2, obfuscation_h3, obfuscation_h4`
+
+func scanServerState(row interface{ Scan(dest ...any) error }) (ServerState, error) {
+	var st ServerState
+	err := row.Scan(&st.ServerPrivateKey, &st.ServerPublicKey, &st.SubnetCIDR, &st.ServerIP, &st.NextHost,
+		&st.SubnetCIDR6, &st.ServerIP6,
+		&st.Obfuscation.Jc, &st.Obfuscation.Jmin, &st.Obfuscation.Jmax, &st.Obfuscation.S1, &st.Obfuscation.S2,
+		&st.Obfuscation.H1, &st.Obfuscation.H2, &st.Obfuscation.H3, &st.Obfuscation.H4)
+	return st, err
+}
+
+func (s *Store) GetServerState(ctx context.Context) (ServerState, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+serverStateColumns+` FROM server_state WHERE id = 1`)
+	st, err := scanServerState(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ServerState{}, ErrNotFound
+	}
+	return st, err
+}
+
+func (s *Store) SaveServerState(ctx context.Context, st ServerState) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO server_state (
+			id, server_private_key, server_public_key, subnet_cidr, server_ip, next_host,
+			subnet_cidr6, server_ip6,
+			obfuscation_jc, obfuscation_jmin, obfuscation_jmax, obfuscation_s1, obfuscation_s2,
+			obfuscation_h1, obfuscation_h2, obfuscation_h3, obfuscation_h4
+		) VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			server_private_key = excluded.server_private_key,
+			server_public_key = excluded.server_public_key,
+			subnet_cidr = excluded.subnet_cidr,
+			server_ip = excluded.server_ip,
+			next_host = excluded.next_host,
+			subnet_cidr6 = excluded.subnet_cidr6,
+			server_ip6 = excluded.server_ip6,
+			obfuscation_jc = excluded.obfuscation_jc,
+			obfuscation_jmin = excluded.obfuscation_jmin,
+			obfuscation_jmax = excluded.obfuscation_jmax,
+			obfuscation_s1 = excluded.obfuscation_s1,
+			obfuscation_s2 = excluded.obfuscation_s2,
+			obfuscation_h1 = excluded.obfuscation_h1,
+			obfuscation_h2 = excluded.obfuscation_h2,
+			obfuscation_h3 = excluded.obfuscation_h3,
+			obfuscation_h4 = excluded.obfuscation_h4`,
+		st.ServerPrivateKey, st.ServerPublicKey, st.SubnetCIDR, st.ServerIP, st.NextHost,
+		st.SubnetCIDR6, st.ServerIP6,
+		st.Obfuscation.Jc, st.Obfuscation.Jmin, st.Obfuscation.Jmax, st.Obfuscation.S1, st.Obfuscation.S2,
+		st.Obfuscation.H1, st.Obfuscation.H2, st.Obfuscation.H3, st.Obfuscation.H4)
+	return err
+}
+
+func scanClient(row interface {
+	Scan(dest ...any) error
+}) (Client, error) {
+	var c Client
+	var expiresAt sql.NullString
+	if err := row.Scan(&c.ID, &c.Name, &c.PublicKey, &c.PrivateKey, &c.Address, &c.CreatedAt, &expiresAt); err != nil {
+		return Client{}, err
+	}
+	if expiresAt.Valid {
+		t, err := time.Parse(time.RFC3339Nano, expiresAt.String)
+		if err != nil {
+			return Client{}, fmt.Errorf("parse expires_at: %w", err)
+		}
+		c.ExpiresAt = &t
+	}
+	return c, nil
+}
+
+const clientColumns = `id, name, public_key, private_key, address, created_at, expires_at`
+
+func (s *Store) ListClients(ctx context.Context) ([]Client, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+clientColumns+` FROM clients ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Client
+	for rows.Next() {
+		c, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) GetClient(ctx context.Context, id string) (Client, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+clientColumns+` FROM clients WHERE id = ?`, id)
+	c, err := scanClient(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Client{}, ErrNotFound
+	}
+	return c, err
+}
+
+// CreateClient inserts c and writes st's subnet and server address fields
+// back in one transaction, so an address handed out by the allocator is
+// either durably claimed together with that server state, or not claimed
+// at all. The clients.address and clients.public_key unique constraints are
+// the backstop against the allocator ever double-assigning under races.
+func (s *Store) CreateClient(ctx context.Context, c Client, st ServerState) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var expiresAt any
+		if c.ExpiresAt != nil {
+			expiresAt = c.ExpiresAt.Format(time.RFC3339Nano)
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO clients (`+clientColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			c.ID, c.Name, c.PublicKey, c.PrivateKey, c.Address, c.CreatedAt.Format(time.RFC3339Nano), expiresAt)
+		if err != nil {
+			return classifyConstraintErr(err)
+		}
+		if err := saveServerStateTx(ctx, tx, st); err != nil {
+			return err
+		}
+		return insertAudit(ctx, tx, "create_client", fmt.Sprintf("id=%s name=%s address=%s", c.ID, c.Name, c.Address))
+	})
+}
+
+func saveServerStateTx(ctx context.Context, tx *sql.Tx, st ServerState) error {
+	_, err := tx.ExecContext(ctx, `UPDATE server_state SET
+			subnet_cidr = ?, server_ip = ?, next_host = ?, subnet_cidr6 = ?, server_ip6 = ?
+		WHERE id = 1`, st.SubnetCIDR, st.ServerIP, st.NextHost, st.SubnetCIDR6, st.ServerIP6)
+	return err
+}
+
+func insertAudit(ctx context.Context, tx *sql.Tx, action, details string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO audit_log (at, action, details) VALUES (?, ?, ?)`,
+		time.Now().UTC().Format(time.RFC3339Nano), action, details)
+	return err
+}
+
+func (s *Store) DeleteClient(ctx context.Context, id string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM clients WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+		return insertAudit(ctx, tx, "delete_client", fmt.Sprintf("id=%s", id))
+	})
+}
+
+func (s *Store) CreateOneTimeLink(ctx context.Context, t DLToken) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		if err := tx.QueryRowContext(ctx, `SELECT 1 FROM clients WHERE id = ?`, t.ClientID).Scan(&exists); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO dl_tokens (token, client_id, expires_at, used) VALUES (?, ?, ?, 0)`,
+			t.Token, t.ClientID, t.ExpiresAt.Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+		return insertAudit(ctx, tx, "create_dl_token", fmt.Sprintf("token=%s client=%s", t.Token, t.ClientID))
+	})
+}
+
+// CountOutstandingTokens returns the number of one-time download tokens that
+// have not yet been consumed and have not expired.
+func (s *Store) CountOutstandingTokens(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM dl_tokens WHERE used = 0 AND expires_at > ?`,
+		time.Now().UTC().Format(time.RFC3339Nano)).Scan(&n)
+	return n, err
+}
+
+// PeekDownloadToken validates token and returns the client and server state
+// it would resolve to, without marking it used. Callers that need to reject
+// a request before spending the token's single use (e.g. a rendered config
+// that turns out too large to encode as a QR code) should check here first,
+// then fall through to ConsumeDownloadToken once they know the fetch will
+// actually succeed.
+func (s *Store) PeekDownloadToken(ctx context.Context, token string) (Client, ServerState, error) {
+	var clientID string
+	var expiresAt string
+	var used bool
+	row := s.db.QueryRowContext(ctx, `SELECT client_id, expires_at, used FROM dl_tokens WHERE token = ?`, token)
+	if err := row.Scan(&clientID, &expiresAt, &used); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Client{}, ServerState{}, ErrNotFound
+		}
+		return Client{}, ServerState{}, err
+	}
+	if used {
+		return Client{}, ServerState{}, ErrTokenUsed
+	}
+	exp, err := time.Parse(time.RFC3339Nano, expiresAt)
+	if err != nil {
+		return Client{}, ServerState{}, err
+	}
+	if time.Now().After(exp) {
+		return Client{}, ServerState{}, ErrTokenExpired
+	}
+
+	c, err := s.GetClient(ctx, clientID)
+	if err != nil {
+		return Client{}, ServerState{}, err
+	}
+	st, err := s.GetServerState(ctx)
+	if err != nil {
+		return Client{}, ServerState{}, err
+	}
+	return c, st, nil
+}
+
+// ConsumeDownloadToken atomically marks token used and returns the client
+// and server state needed to render its config, so a token can never be
+// fetched twice even under concurrent requests.
+func (s *Store) ConsumeDownloadToken(ctx context.Context, token string) (Client, ServerState, error) {
+	var c Client
+	var st ServerState
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var clientID string
+		var expiresAt string
+		var used bool
+		row := tx.QueryRowContext(ctx, `SELECT client_id, expires_at, used FROM dl_tokens WHERE token = ?`, token)
+		if err := row.Scan(&clientID, &expiresAt, &used); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if used {
+			return ErrTokenUsed
+		}
+		exp, err := time.Parse(time.RFC3339Nano, expiresAt)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(exp) {
+			return ErrTokenExpired
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE dl_tokens SET used = 1 WHERE token = ?`, token); err != nil {
+			return err
+		}
+
+		cRow := tx.QueryRowContext(ctx, `SELECT `+clientColumns+` FROM clients WHERE id = ?`, clientID)
+		client, err := scanClient(cRow)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		c = client
+
+		stRow := tx.QueryRowContext(ctx, `SELECT `+serverStateColumns+` FROM server_state WHERE id = 1`)
+		serverState, err := scanServerState(stRow)
+		if err != nil {
+			return err
+		}
+		st = serverState
+
+		return insertAudit(ctx, tx, "consume_dl_token", fmt.Sprintf("token=%s client=%s", token, clientID))
+	})
+	if err != nil {
+		return Client{}, ServerState{}, err
+	}
+	return c, st, nil
+}
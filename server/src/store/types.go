@@ -0,0 +1,45 @@
+package store
+
+import "time"
+
+// ServerState is the server's own keypair, subnet, and server-wide junk
+// profile. There is always exactly one row of this in the database.
+type ServerState struct {
+	ServerPrivateKey string
+	ServerPublicKey  string
+
+	SubnetCIDR string // e.g. 10.8.0.0/24
+	ServerIP   string // e.g. 10.8.0.1
+	NextHost   int    // retained for backward compatibility; unused since the CIDR allocator landed
+
+	// SubnetCIDR6/ServerIP6 are set only when dual-stack IPv6 is enabled.
+	SubnetCIDR6 string // e.g. fd00:8::/64
+	ServerIP6   string // e.g. fd00:8::1
+
+	// Obfuscation is the AmneziaWG junk/header profile applied to every
+	// client. It's server-wide rather than per-client because Jc/Jmin/Jmax/
+	// S1/S2/H1-4 are [Interface]-level handshake parameters the server and
+	// every peer must agree on identically; there's no [Peer]-level
+	// equivalent to vary it by client.
+	Obfuscation ObfuscationParams
+}
+
+// Client is a configured WireGuard peer.
+type Client struct {
+	ID         string
+	Name       string
+	PublicKey  string
+	PrivateKey string
+	Address    string // e.g. 10.8.0.2/32
+	CreatedAt  time.Time
+	ExpiresAt  *time.Time
+}
+
+// DLToken is a one-time download token for handing a client's rendered
+// config to an end user without exposing the admin API.
+type DLToken struct {
+	Token     string
+	ClientID  string
+	ExpiresAt time.Time
+	Used      bool
+}